@@ -0,0 +1,65 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dstest
+
+import (
+	"context"
+	"regexp"
+	"testing"
+
+	"cloud.google.com/go/bigtable"
+)
+
+var bigtableEnvRegexp = regexp.MustCompile(`^\[bigtable\] +export (BIGTABLE_EMULATOR_HOST)=(.+)$`)
+
+// BigtableEmulator starts a Cloud Bigtable emulator; see
+// https://cloud.google.com/bigtable/docs/emulator.  When the test ends, the
+// returned client is automatically closed and the emulator process is
+// killed.  As with [Emulator], don’t pass t.Context() as ctx.  Unlike the
+// other *Emulator functions, BigtableEmulator requires the [Instance]
+// option, since [cloud.google.com/go/bigtable.NewClient] needs an instance
+// ID; of the remaining [Option] types, only [ProjectID], [StartTimeout], and
+// [StopTimeout] apply here.
+func BigtableEmulator(ctx context.Context, t testing.TB, opts ...Option) *bigtable.Client {
+	t.Helper()
+	o := newOptions(opts)
+	if o.instance == "" {
+		t.Fatal("dstest: BigtableEmulator requires the Instance option")
+	}
+
+	args := []string{"beta", "emulators", "bigtable", "start"}
+	if o.projectID != "" {
+		args = append(args, "--project="+o.projectID)
+	}
+	env, _, shutdownProcess := runEmulator(ctx, t, o.startTimeout, o.stopTimeout, args, bigtableEnvRegexp)
+	t.Setenv(env.name, env.value)
+
+	projectID := o.projectID
+	if projectID == "" {
+		projectID = defaultProjectID
+	}
+	client, err := bigtable.NewClient(ctx, projectID, o.instance)
+	if err != nil {
+		t.Fatalf("dstest: error creating Bigtable client: %s", err)
+	}
+	t.Cleanup(func() {
+		t.Log("dstest: closing Bigtable client")
+		if err := client.Close(); err != nil {
+			t.Logf("dstest: couldn’t close Bigtable client: %s", err)
+		}
+		shutdownProcess()
+	})
+	return client
+}
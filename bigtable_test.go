@@ -0,0 +1,55 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dstest_test
+
+import (
+	"context"
+	"testing"
+
+	"cloud.google.com/go/bigtable"
+	"github.com/phst/dstest"
+)
+
+func TestBigtableEmulator(t *testing.T) {
+	ctx := context.Background()
+	client := dstest.BigtableEmulator(ctx, t, dstest.Instance("instance"), dstest.ProjectID("project"))
+
+	admin, err := bigtable.NewAdminClient(ctx, "project", "instance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close()
+	if err := admin.CreateTable(ctx, "table"); err != nil {
+		t.Fatal(err)
+	}
+	if err := admin.CreateColumnFamily(ctx, "table", "family"); err != nil {
+		t.Fatal(err)
+	}
+
+	tbl := client.Open("table")
+	mut := bigtable.NewMutation()
+	mut.Set("family", "column", bigtable.Now(), []byte("value"))
+	if err := tbl.Apply(ctx, "row", mut); err != nil {
+		t.Fatal(err)
+	}
+	row, err := tbl.ReadRow(ctx, "row")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cells := row["family"]
+	if len(cells) != 1 || string(cells[0].Value) != "value" {
+		t.Errorf("got row %v, want a single cell with value %q", row, "value")
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dstest
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/freeport"
+	"github.com/frioux/shellquote"
+	"github.com/hashicorp/go-retryablehttp"
+)
+
+// runEmulator starts a `gcloud …` emulator process and waits for it to
+// become healthy.  It implements the machinery shared by all of this
+// package's *Emulator functions: free-port allocation, stdout scraping for
+// the “export FOO=host:port” line (matched using envRegexp), a health
+// check, and asking the process to shut down via its HTTP admin endpoint.
+// subArgs are the gcloud arguments identifying the emulator and any of its
+// flags, not including --host-port, which runEmulator appends itself.
+//
+// It returns the environment variable the emulator reported and an
+// HTTP client that can be used to talk to it (e.g. for [Handle.Reset]), plus
+// a function that shuts the process down.  Unlike [Emulator], runEmulator
+// doesn’t register the shutdown with t.Cleanup itself, so that callers such
+// as [SharedEmulator] can defer shutdown until the last interested test has
+// finished.
+func runEmulator(ctx context.Context, t testing.TB, startTimeout, stopTimeout time.Duration, subArgs []string, envRegexp *regexp.Regexp) (envVar, *retryablehttp.Client, func()) {
+	t.Helper()
+
+	startCtx, cancel := context.WithTimeout(ctx, startTimeout)
+	defer cancel()
+
+	port, err := freeport.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := append(append([]string{}, subArgs...), "--host-port=localhost:"+strconv.Itoa(port))
+	cmd := exec.CommandContext(ctx, "gcloud", args...)
+
+	envCh := make(chan envVar, 1)
+	pr, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd.Stderr = cmd.Stdout
+
+	t.Log("dstest: starting emulator")
+	cmdLine, err := shellquote.Quote(cmd.Args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log("dstest:", cmdLine)
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("dstest: couldn’t start emulator: %s", err)
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		s := bufio.NewScanner(pr)
+		for s.Scan() {
+			line := s.Text()
+			t.Log("dstest:", line)
+			if m := envRegexp.FindStringSubmatch(line); m != nil {
+				envCh <- envVar{m[1], m[2]}
+			}
+		}
+		if err := s.Err(); err != nil {
+			t.Errorf("dstest: couldn’t read output of emulator: %s", err)
+		}
+		close(envCh)
+		io.Copy(io.Discard, pr)
+		if err := cmd.Wait(); err != nil {
+			t.Errorf("dstest: emulator failed: %s", err)
+		}
+		t.Log("dstest: emulator terminated")
+	}()
+
+	t.Log("dstest: emulator started; waiting for startup")
+	var env envVar
+	select {
+	case env = <-envCh:
+	case <-startCtx.Done():
+		t.Fatalf("dstest: emulator didn’t start up: %s", startCtx.Err())
+	}
+
+	if env.name == "" || env.value == "" {
+		t.Fatal("dstest: emulator didn’t start up")
+	}
+	t.Logf("dstest: emulator running at %s; waiting for health check", env.value)
+	httpClient := retryablehttp.NewClient()
+	httpClient.Logger = logger{t}
+	// This could be a HEAD request, but the emulators don’t accept those.
+	req, err := retryablehttp.NewRequestWithContext(startCtx, http.MethodGet, fmt.Sprintf("http://%s/", env.value), nil)
+	if err != nil {
+		t.Fatalf("dstest: health check failed: %s", err)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		t.Fatalf("dstest: health check failed: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("dstest: health check failed with HTTP status %s", resp.Status)
+	}
+	t.Logf("dstest: emulator running at %s is healthy", env.value)
+
+	shutdown := func() {
+		ctx, cancel := context.WithTimeout(ctx, stopTimeout)
+		defer cancel()
+		t.Log("dstest: asking emulator to shut down")
+		req, err := retryablehttp.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("http://%s/shutdown", env.value), nil)
+		if err != nil {
+			t.Logf("dstest: stopping emulator failed: %s", err)
+			return
+		}
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			t.Logf("dstest: stopping emulator failed: %s", err)
+			return
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Logf("dstest: stopping emulator failed: %s", resp.Status)
+			return
+		}
+		t.Log("dstest: waiting for emulator to stop")
+		wg.Wait()
+	}
+	return env, httpClient, shutdown
+}
+
+type envVar struct{ name, value string }
@@ -12,17 +12,17 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-// Package dstest contains functionality to help with testing code that relies
-// on the Google Cloud Datastore.
+// Package dstest contains functionality to help with testing code that
+// relies on the Google Cloud Datastore, as well as sibling functions for
+// other `gcloud` emulators: [FirestoreEmulator], [PubSubEmulator], and
+// [BigtableEmulator].
 package dstest
 
 import (
-	"bufio"
 	"context"
 	"fmt"
-	"io"
 	"net/http"
-	"os/exec"
+	"os"
 	"regexp"
 	"strconv"
 	"sync"
@@ -30,44 +30,66 @@ import (
 	"time"
 
 	"cloud.google.com/go/datastore"
-	"github.com/facebookgo/freeport"
-	"github.com/frioux/shellquote"
 	"github.com/hashicorp/go-retryablehttp"
 )
 
 // Emulator starts a Cloud Datastore emulator; see
 // https://cloud.google.com/datastore/docs/tools/datastore-emulator.  When the
-// test ends, the returned client is automatically closed and the emulator
-// process is killed.  If the given context has a deadline, it is applied to
-// the entire running time of the emulator process; this means that you
-// shouldn’t pass t.Context() because it’ll get cancelled before Emulator gets
-// a chance to clean up the datastore process.  Unless overridden by passing
-// [Option] arguments, this function will start the emulator in Firestore mode
-// and wait up to 20 seconds for it to start up and stop, respectively.
-func Emulator(ctx context.Context, t testing.TB, opts ...Option) *datastore.Client {
+// test ends, the returned handle’s client is automatically closed and the
+// emulator process is killed.  If the given context has a deadline, it is
+// applied to the entire running time of the emulator process; this means
+// that you shouldn’t pass t.Context() because it’ll get cancelled before
+// Emulator gets a chance to clean up the datastore process.  Unless
+// overridden by passing [Option] arguments, this function will start the
+// emulator in Firestore mode, with full consistency, and wait up to 20
+// seconds for it to start up and stop, respectively.
+func Emulator(ctx context.Context, t testing.TB, opts ...Option) *Handle {
 	t.Helper()
+	h, shutdown := start(ctx, t, newOptions(opts), t.Setenv)
+	t.Cleanup(shutdown)
+	return h
+}
 
+// newOptions computes the effective options from the given [Option] values,
+// applying them on top of the defaults.
+func newOptions(opts []Option) options {
 	o := options{
 		mode:         FirestoreMode,
 		startTimeout: 20 * time.Second,
 		stopTimeout:  20 * time.Second,
+		consistency:  1.0,
 	}
 	for _, opt := range opts {
 		opt.apply(&o)
 	}
+	return o
+}
 
-	startCtx, cancel := context.WithTimeout(ctx, o.startTimeout)
-	defer cancel()
+// start starts a Cloud Datastore emulator process with the given options and
+// returns a handle to it along with a function that shuts it down.  Unlike
+// [Emulator], it doesn’t register the shutdown with t.Cleanup itself, so that
+// callers such as [SharedEmulator] can defer shutdown until the last
+// interested test has finished.  It calls setenv to set the emulator’s
+// environment variable before creating the client.
+func start(ctx context.Context, t testing.TB, o options, setenv func(key, value string)) (*Handle, func()) {
+	t.Helper()
 
-	port, err := freeport.Get()
+	// Deliberately not t.TempDir(): for [SharedEmulator], t is only the
+	// first caller to request this set of options, and its cleanup stack
+	// runs as soon as *that* test ends, which can be long before the
+	// shared emulator's last remaining caller finishes with it. Tie the
+	// data directory's lifetime to the shutdown closure instead, which
+	// only runs once, when the emulator itself is actually torn down.
+	dataDir, err := os.MkdirTemp("", "dstest-datastore-")
 	if err != nil {
-		t.Fatal(err)
+		t.Fatalf("dstest: couldn’t create emulator data directory: %s", err)
 	}
+
 	args := []string{
 		"beta", "emulators", "datastore", "start",
-		"--data-dir=" + t.TempDir(),
-		"--host-port=localhost:" + strconv.Itoa(port),
+		"--data-dir=" + dataDir,
 		"--no-store-on-disk",
+		"--consistency=" + strconv.FormatFloat(o.consistency, 'g', -1, 64),
 	}
 	switch m := o.mode; m {
 	case FirestoreMode:
@@ -76,115 +98,185 @@ func Emulator(ctx context.Context, t testing.TB, opts ...Option) *datastore.Clie
 	default:
 		t.Fatalf("invalid mode %v", m)
 	}
-	cmd := exec.CommandContext(ctx, "gcloud", args...)
+	if o.projectID != "" {
+		args = append(args, "--project="+o.projectID)
+	}
+	env, httpClient, shutdownProcess := runEmulator(ctx, t, o.startTimeout, o.stopTimeout, args, datastoreEnvRegexp)
 
-	envCh := make(chan envVar, 1)
-	pr, err := cmd.StdoutPipe()
-	if err != nil {
-		t.Fatal(err)
+	host := env.value
+	var proxy *faultProxy
+	if o.faultInjection {
+		var err error
+		proxy, err = newFaultProxy(env.value)
+		if err != nil {
+			t.Fatalf("dstest: couldn’t start fault-injection proxy: %s", err)
+		}
+		host = proxy.addr()
+		t.Logf("dstest: fault-injection proxy for %s listening at %s", env.value, host)
 	}
-	cmd.Stderr = cmd.Stdout
+	setenv(env.name, host)
 
-	t.Log("dstest: starting Cloud Datastore emulator")
-	cmdLine, err := shellquote.Quote(cmd.Args)
-	if err != nil {
-		t.Fatal(err)
+	projectID := o.projectID
+	if projectID == "" {
+		projectID = datastore.DetectProjectID
 	}
-	t.Log("dstest:", cmdLine)
-	if err := cmd.Start(); err != nil {
-		t.Fatalf("dstest: couldn’t start Cloud Datastore emulator: %s", err)
+	client, err := datastore.NewClient(ctx, projectID)
+	if err != nil {
+		t.Fatalf("dstest: error creating Cloud Datastore client: %s", err)
 	}
-	var wg sync.WaitGroup
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		s := bufio.NewScanner(pr)
-		for s.Scan() {
-			line := s.Text()
-			t.Log("dstest:", line)
-			if m := envRegexp.FindStringSubmatch(line); m != nil {
-				envCh <- envVar{m[1], m[2]}
-			}
+	shutdown := func() {
+		t.Log("dstest: closing datastore client")
+		if err := client.Close(); err != nil {
+			t.Logf("dstest: couldn’t close datastore client: %s", err)
 		}
-		if err := s.Err(); err != nil {
-			t.Errorf("dstest: couldn’t read output of Cloud Datastore emulator: %s", err)
+		shutdownProcess()
+		if proxy != nil {
+			t.Log("dstest: closing fault-injection proxy")
+			if err := proxy.close(); err != nil {
+				t.Logf("dstest: couldn’t close fault-injection proxy: %s", err)
+			}
 		}
-		close(envCh)
-		io.Copy(io.Discard, pr)
-		if err := cmd.Wait(); err != nil {
-			t.Errorf("dstest: Cloud Datastore emulator failed: %s", err)
+		if err := os.RemoveAll(dataDir); err != nil {
+			t.Logf("dstest: couldn’t remove emulator data directory: %s", err)
 		}
-		t.Log("dstest: Cloud Datastore emulator terminated")
-	}()
-
-	t.Log("dstest: Cloud Datastore emulator started; waiting for startup")
-	var env envVar
-	select {
-	case env = <-envCh:
-	case <-startCtx.Done():
-		t.Fatalf("dstest: Cloud Datastore emulator didn’t start up: %s", startCtx.Err())
 	}
+	return &Handle{client: client, host: host, httpClient: httpClient, proxy: proxy}, shutdown
+}
 
-	if env.name == "" || env.value == "" {
-		t.Fatal("dstest: Cloud Datastore emulator didn’t start up")
-	}
-	t.Logf("dstest: Cloud Datastore emulator running at %s; waiting for health check", env.value)
-	httpClient := retryablehttp.NewClient()
-	httpClient.Logger = logger{t}
-	// This could be a HEAD request, but the datastore emulator doesn’t
-	// accept those.
-	req, err := retryablehttp.NewRequestWithContext(startCtx, http.MethodGet, fmt.Sprintf("http://%s/", env.value), nil)
+// Handle represents a running Cloud Datastore emulator process, as returned
+// by [Emulator].
+type Handle struct {
+	client     *datastore.Client
+	host       string
+	httpClient *retryablehttp.Client
+	proxy      *faultProxy
+}
+
+// Client returns the Datastore client connected to the emulator.
+func (h *Handle) Client() *datastore.Client { return h.client }
+
+// Host returns the “host:port” address the emulator is listening on (or,
+// with the [FaultInjection] option, the address of the proxy in front of
+// it), as found in the DATASTORE_EMULATOR_HOST environment variable.
+func (h *Handle) Host() string { return h.host }
+
+// Reset clears all entities stored by the emulator, without restarting the
+// emulator process.  This is considerably cheaper than starting a fresh
+// [Emulator] for every subtest, while still giving each subtest a clean
+// slate; a typical use is at the start of each iteration of a t.Run loop.
+func (h *Handle) Reset(ctx context.Context) error {
+	req, err := retryablehttp.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("http://%s/reset", h.host), nil)
 	if err != nil {
-		t.Fatalf("dstest: health check failed: %s", err)
+		return fmt.Errorf("dstest: couldn’t create reset request: %w", err)
 	}
-	resp, err := httpClient.Do(req)
+	resp, err := h.httpClient.Do(req)
 	if err != nil {
-		t.Fatalf("dstest: health check failed: %s", err)
+		return fmt.Errorf("dstest: couldn’t reset Cloud Datastore emulator: %w", err)
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		t.Fatalf("dstest: health check failed with HTTP status %s", resp.Status)
+		return fmt.Errorf("dstest: couldn’t reset Cloud Datastore emulator: %s", resp.Status)
 	}
+	return nil
+}
 
-	t.Logf("dstest: Cloud Datastore emulator running at %s is healthy", env.value)
-	t.Cleanup(func() {
-		ctx, cancel := context.WithTimeout(ctx, o.stopTimeout)
-		defer cancel()
-		t.Log("dstest: asking Cloud Datastore emulator to shut down")
-		req, err := retryablehttp.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("http://%s/shutdown", env.value), nil)
-		if err != nil {
-			t.Logf("dstest: stopping Cloud Datastore emulator failed: %s", err)
-			return
-		}
-		resp, err := httpClient.Do(req)
-		if err != nil {
-			t.Logf("dstest: stopping Cloud Datastore emulator failed: %s", err)
-			return
-		}
-		defer resp.Body.Close()
-		if resp.StatusCode != http.StatusOK {
-			t.Logf("dstest: stopping Cloud Datastore emulator failed: %s", resp.Status)
-			return
-		}
-		t.Log("dstest: waiting for Cloud Datastore emulator to stop")
-		wg.Wait()
-	})
-	t.Setenv(env.name, env.value)
+// InjectFaults queues scripted failure responses for the given Datastore
+// gRPC method, e.g. "google.datastore.v1.Datastore/RunQuery". Each response
+// is a gRPC status code name as returned by [google.golang.org/grpc/codes.Code.String],
+// optionally followed by ":" and a message, e.g.
+// "FailedPrecondition:injected fault". The next that many calls to method
+// fail with the corresponding gRPC status instead of reaching the emulator;
+// once the queue is empty, calls are forwarded normally again. Note that
+// [cloud.google.com/go/datastore.Client] itself transparently retries
+// codes.Unavailable (and a few other codes) until the context deadline, so a
+// single queued Unavailable fault is invisible to callers; queue enough
+// consecutive Unavailable faults to exceed the client's retry budget, or use
+// a code the client doesn't retry, if you want the caller to observe the
+// error. This requires the emulator to have been started with the
+// [FaultInjection] option, which routes the [datastore.Client] through an
+// in-process proxy; InjectFaults panics otherwise.
+func (h *Handle) InjectFaults(method string, responses ...string) {
+	if h.proxy == nil {
+		panic("dstest: InjectFaults requires the emulator to be started with the FaultInjection option")
+	}
+	h.proxy.inject(method, responses)
+}
 
-	client, err := datastore.NewClient(ctx, datastore.DetectProjectID)
-	if err != nil {
-		t.Fatalf("dstest: error creating Cloud Datastore client: %s", err)
+var (
+	sharedMu    sync.Mutex
+	sharedInsts = map[options]*sharedEmulator{}
+)
+
+// sharedEmulator is a reference-counted emulator process shared by multiple
+// callers of [SharedEmulator] that request the same options.
+type sharedEmulator struct {
+	refs     int
+	handle   *Handle
+	shutdown func()
+}
+
+// SharedEmulator returns a [Handle] backed by a Cloud Datastore emulator
+// that’s shared across all callers within the same test binary that request
+// the same options.  At most one emulator process per distinct set of
+// options runs at a time: it’s started lazily by the first caller and torn
+// down, via tb.Cleanup, once the last caller currently holding it has
+// finished.  Callers whose lifetimes don’t overlap, such as sequential
+// subtests whose parent test holds no reference of its own, therefore each
+// get a freshly started emulator.  The returned Handle is shared too; if
+// callers run sequentially while the emulator is held (e.g. t.Run subtests
+// without t.Parallel whose parent test also called SharedEmulator), call
+// [Handle.Reset] at the start of each one to give it a clean slate, but
+// don’t do that if callers
+// run concurrently, since they’d wipe each other’s data, and don’t call
+// [Handle.InjectFaults] on it, since the resulting faults would leak into
+// unrelated callers. This is considerably cheaper than starting a fresh
+// [Emulator] per test when a package has many datastore tests that don’t
+// need full process isolation from each other. Callers that do need
+// per-test isolation should keep using [Emulator] instead.
+func SharedEmulator(ctx context.Context, tb testing.TB, opts ...Option) *Handle {
+	tb.Helper()
+	o := newOptions(opts)
+
+	sharedMu.Lock()
+	inst, ok := sharedInsts[o]
+	if !ok {
+		// tb.Setenv panics once tb (or an ancestor) has called t.Parallel,
+		// which is exactly the scenario SharedEmulator is meant to support.
+		// Set the process-wide env var directly instead, once, under
+		// sharedMu, when this instance is first created; unset it again in
+		// the cleanup below once the instance is torn down.
+		handle, shutdown := start(ctx, tb, o, func(key, value string) {
+			if err := os.Setenv(key, value); err != nil {
+				sharedMu.Unlock()
+				tb.Fatalf("dstest: couldn’t set %s: %s", key, err)
+			}
+		})
+		inst = &sharedEmulator{handle: handle, shutdown: shutdown}
+		sharedInsts[o] = inst
 	}
-	t.Cleanup(func() {
-		t.Log("dstest: closing datastore client")
-		if err := client.Close(); err != nil {
-			t.Logf("dstest: couldn’t close datastore client: %s", err)
+	inst.refs++
+	sharedMu.Unlock()
+
+	tb.Cleanup(func() {
+		sharedMu.Lock()
+		defer sharedMu.Unlock()
+		inst.refs--
+		if inst.refs > 0 {
+			return
+		}
+		delete(sharedInsts, o)
+		inst.shutdown()
+		if err := os.Unsetenv("DATASTORE_EMULATOR_HOST"); err != nil {
+			tb.Logf("dstest: couldn’t unset DATASTORE_EMULATOR_HOST: %s", err)
 		}
 	})
-	return client
+	return inst.handle
 }
 
-// Option is an option for [Emulator].  The current implementations are [Mode],
-// [StartTimeout], and [StopTimeout].
+// Option is an option for [Emulator] and the other *Emulator functions.  The
+// current implementations are [Mode], [StartTimeout], [StopTimeout],
+// [Consistency], [ProjectID], [FaultInjection], and [Instance]; not every
+// option is meaningful for every emulator type, as noted in their docs.
 type Option interface {
 	apply(*options)
 }
@@ -224,11 +316,71 @@ func (t StopTimeout) apply(o *options) {
 	o.stopTimeout = time.Duration(t)
 }
 
+// Consistency is an [Option] that determines the fraction of eventually
+// consistent writes that show up immediately in global queries against the
+// emulator, as passed to --consistency=.  It defaults to 1.0, i.e. fully
+// consistent, which gives tests read-your-writes semantics even in
+// [LegacyMode]; pass a lower value to exercise eventual-consistency
+// behavior instead.
+type Consistency float64
+
+var _ Option = Consistency(0)
+
+func (c Consistency) apply(o *options) {
+	o.consistency = float64(c)
+}
+
+// ProjectID is an [Option] that sets the Google Cloud project ID to use,
+// both for the emulator process (--project=) and for the returned Datastore
+// client.  If not given, the emulator runs without an explicit project and
+// the client falls back to [cloud.google.com/go/datastore.DetectProjectID],
+// which requires ambient project configuration (e.g. via `gcloud config`)
+// and therefore doesn’t work out of the box in hermetic CI environments.
+type ProjectID string
+
+var _ Option = ProjectID("")
+
+func (p ProjectID) apply(o *options) {
+	o.projectID = string(p)
+}
+
+// FaultInjection is an [Option] that, if true, routes the returned
+// [datastore.Client] through an in-process proxy that can inject scripted
+// failure responses via [Handle.InjectFaults].  It’s off by default, since it
+// has a small performance cost and isn’t needed by tests that only exercise
+// the happy path.
+type FaultInjection bool
+
+var _ Option = FaultInjection(false)
+
+func (f FaultInjection) apply(o *options) {
+	o.faultInjection = bool(f)
+}
+
+// Instance is an [Option] that sets the Bigtable instance ID to use, as
+// passed to [cloud.google.com/go/bigtable.NewClient].  It’s ignored by every
+// *Emulator function except [BigtableEmulator], which requires it.
+type Instance string
+
+var _ Option = Instance("")
+
+func (i Instance) apply(o *options) {
+	o.instance = string(i)
+}
+
 type options struct {
 	mode                      Mode
 	startTimeout, stopTimeout time.Duration
+	consistency               float64
+	projectID                 string
+	instance                  string
+	faultInjection            bool
 }
 
-type envVar struct{ name, value string }
+// defaultProjectID is the project ID used by *Emulator functions whose
+// underlying client, unlike [cloud.google.com/go/datastore.Client], requires
+// an explicit, nonempty project ID and has no [ProjectID]-less detection
+// fallback.  Its value doesn’t matter, since the emulators don’t check it.
+const defaultProjectID = "dstest-emulator"
 
-var envRegexp = regexp.MustCompile(`^\[datastore\] +export (DATASTORE_EMULATOR_HOST)=(.+)$`)
+var datastoreEnvRegexp = regexp.MustCompile(`^\[datastore\] +export (DATASTORE_EMULATOR_HOST)=(.+)$`)
@@ -25,7 +25,8 @@ import (
 
 func TestEmulator(t *testing.T) {
 	ctx := context.Background()
-	client := dstest.Emulator(ctx, t)
+	h := dstest.Emulator(ctx, t)
+	client := h.Client()
 	type entity struct{ Value int }
 	if _, err := client.Put(ctx, datastore.IncompleteKey("kind", nil), &entity{123}); err != nil {
 		t.Error(err)
@@ -39,3 +40,180 @@ func TestEmulator(t *testing.T) {
 		t.Error("-got +want", diff)
 	}
 }
+
+func TestEmulatorReset(t *testing.T) {
+	ctx := context.Background()
+	h := dstest.Emulator(ctx, t)
+	client := h.Client()
+	type entity struct{ Value int }
+	if _, err := client.Put(ctx, datastore.IncompleteKey("kind", nil), &entity{123}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Reset(ctx); err != nil {
+		t.Fatal(err)
+	}
+	var got []entity
+	if _, err := client.GetAll(ctx, datastore.NewQuery("kind"), &got); err != nil {
+		t.Error(err)
+	}
+	if len(got) != 0 {
+		t.Errorf("got %d entities after reset, want 0", len(got))
+	}
+}
+
+func TestEmulatorProjectID(t *testing.T) {
+	ctx := context.Background()
+	h := dstest.Emulator(ctx, t, dstest.ProjectID("some-project"), dstest.Consistency(1.0))
+	client := h.Client()
+	type entity struct{ Value int }
+	if _, err := client.Put(ctx, datastore.IncompleteKey("kind", nil), &entity{123}); err != nil {
+		t.Error(err)
+	}
+	var got []entity
+	if _, err := client.GetAll(ctx, datastore.NewQuery("kind"), &got); err != nil {
+		t.Error(err)
+	}
+	want := []entity{{123}}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Error("-got +want", diff)
+	}
+}
+
+func TestEmulatorInjectFaults(t *testing.T) {
+	ctx := context.Background()
+	h := dstest.Emulator(ctx, t, dstest.FaultInjection(true))
+	client := h.Client()
+	// FailedPrecondition, unlike Unavailable, isn’t transparently retried by
+	// the client, so the injected fault is actually observable here.
+	h.InjectFaults("google.datastore.v1.Datastore/Commit", "FailedPrecondition:injected fault")
+	type entity struct{ Value int }
+	if _, err := client.Put(ctx, datastore.IncompleteKey("kind", nil), &entity{123}); err == nil {
+		t.Error("Put: got no error, want injected fault")
+	}
+	if _, err := client.Put(ctx, datastore.IncompleteKey("kind", nil), &entity{123}); err != nil {
+		t.Errorf("Put after fault was consumed: got error %s, want none", err)
+	}
+}
+
+func TestEmulatorSeedSnapshotRestore(t *testing.T) {
+	ctx := context.Background()
+	h := dstest.Emulator(ctx, t)
+	client := h.Client()
+	type entity struct{ Value int }
+
+	if err := h.Seed(ctx,
+		dstest.SeedEntity{Key: datastore.NameKey("kind", "a", nil), Value: &entity{1}},
+		dstest.SeedEntity{Key: datastore.NameKey("kind", "b", nil), Value: &entity{2}},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	snap, err := h.Snapshot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.Reset(ctx); err != nil {
+		t.Fatal(err)
+	}
+	var gotAfterReset []entity
+	if _, err := client.GetAll(ctx, datastore.NewQuery("kind"), &gotAfterReset); err != nil {
+		t.Error(err)
+	}
+	if len(gotAfterReset) != 0 {
+		t.Errorf("got %d entities after reset, want 0", len(gotAfterReset))
+	}
+
+	if err := h.Restore(ctx, snap); err != nil {
+		t.Fatal(err)
+	}
+	var got []entity
+	if _, err := client.GetAll(ctx, datastore.NewQuery("kind").Order("Value"), &got); err != nil {
+		t.Error(err)
+	}
+	want := []entity{{1}, {2}}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Error("-got +want", diff)
+	}
+}
+
+func TestEmulatorSnapshotNamespace(t *testing.T) {
+	ctx := context.Background()
+	h := dstest.Emulator(ctx, t)
+	client := h.Client()
+	type entity struct{ Value int }
+
+	key := datastore.NameKey("kind", "a", nil)
+	key.Namespace = "ns"
+	if err := h.Seed(ctx, dstest.SeedEntity{Key: key, Value: &entity{1}}); err != nil {
+		t.Fatal(err)
+	}
+
+	snap, err := h.Snapshot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Reset(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Restore(ctx, snap); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []entity
+	gotKeys, err := client.GetAll(ctx, datastore.NewQuery("kind").Namespace("ns"), &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []entity{{1}}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Error("-got +want", diff)
+	}
+	if len(gotKeys) != 1 || gotKeys[0].Namespace != "ns" {
+		t.Errorf("got keys %v, want a single key in namespace %q", gotKeys, "ns")
+	}
+}
+
+func TestEmulatorSnapshotUnsupportedPropertyType(t *testing.T) {
+	ctx := context.Background()
+	h := dstest.Emulator(ctx, t)
+	client := h.Client()
+
+	props := datastore.PropertyList{
+		{Name: "Location", Value: datastore.GeoPoint{Lat: 1, Lng: 2}},
+	}
+	if _, err := client.Put(ctx, datastore.NameKey("kind", "a", nil), &props); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := h.Snapshot(ctx); err == nil {
+		t.Error("Snapshot: got no error, want one for unsupported property type datastore.GeoPoint")
+	}
+}
+
+func TestSharedEmulator(t *testing.T) {
+	ctx := context.Background()
+	type entity struct{ Value int }
+	for i, kind := range []string{"kind1", "kind2"} {
+		i, kind := i, kind
+		t.Run(kind, func(t *testing.T) {
+			// Run in parallel so that both subtests are holding onto the
+			// shared emulator at the same time, exercising the case where
+			// sharedEmulator.refs is greater than one.
+			t.Parallel()
+			h := dstest.SharedEmulator(ctx, t)
+			client := h.Client()
+			if _, err := client.Put(ctx, datastore.IncompleteKey(kind, nil), &entity{i}); err != nil {
+				t.Fatal(err)
+			}
+			var got []entity
+			if _, err := client.GetAll(ctx, datastore.NewQuery(kind), &got); err != nil {
+				t.Error(err)
+			}
+			want := []entity{{i}}
+			if diff := cmp.Diff(got, want); diff != "" {
+				t.Error("-got +want", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,315 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dstest
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+	"google.golang.org/grpc/codes"
+)
+
+// faultProxy is a transparent TCP proxy that sits in front of a Cloud
+// Datastore emulator and can answer individual gRPC calls with a scripted
+// failure instead of forwarding them, as queued by [Handle.InjectFaults].
+// The datastore emulator serves both its gRPC API and its plain HTTP admin
+// endpoints (used by the health check, [Handle.Reset], and emulator
+// shutdown) on the same host:port, so faultProxy inspects the first bytes of
+// each connection to tell the two apart: HTTP/2 connections are parsed frame
+// by frame so that request HEADERS can be matched against queued faults,
+// while everything else is copied through unmodified.
+type faultProxy struct {
+	listener net.Listener
+	backend  string
+
+	mu     sync.Mutex
+	faults map[string][]string
+}
+
+// newFaultProxy starts a faultProxy that forwards to the given backend
+// address and returns once it’s ready to accept connections.
+func newFaultProxy(backend string) (*faultProxy, error) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		return nil, err
+	}
+	p := &faultProxy{listener: ln, backend: backend, faults: map[string][]string{}}
+	go p.serve()
+	return p, nil
+}
+
+// addr returns the host:port the proxy listens on.
+func (p *faultProxy) addr() string { return p.listener.Addr().String() }
+
+// close stops accepting new connections.  Connections already being proxied
+// are left to finish on their own.
+func (p *faultProxy) close() error { return p.listener.Close() }
+
+// inject queues responses to be returned, in order, for future calls to the
+// given gRPC method instead of forwarding them to the backend.
+func (p *faultProxy) inject(method string, responses []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.faults[method] = append(p.faults[method], responses...)
+}
+
+// nextFault returns and consumes the next queued response for method, if
+// any.
+func (p *faultProxy) nextFault(method string) (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	q, ok := p.faults[method]
+	if !ok || len(q) == 0 {
+		return "", false
+	}
+	p.faults[method] = q[1:]
+	return q[0], true
+}
+
+func (p *faultProxy) serve() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		go p.handle(conn)
+	}
+}
+
+func (p *faultProxy) handle(clientConn net.Conn) {
+	defer clientConn.Close()
+
+	br := bufio.NewReader(clientConn)
+	preface, err := br.Peek(len(http2.ClientPreface))
+	if err != nil || string(preface) != http2.ClientPreface {
+		p.passthrough(clientConn, br)
+		return
+	}
+	if _, err := br.Discard(len(http2.ClientPreface)); err != nil {
+		return
+	}
+
+	backendConn, err := net.Dial("tcp", p.backend)
+	if err != nil {
+		return
+	}
+	defer backendConn.Close()
+	if _, err := backendConn.Write(preface); err != nil {
+		return
+	}
+
+	var writeMu sync.Mutex
+	clientWriter := &lockedWriter{mu: &writeMu, w: clientConn}
+
+	// Backend responses are never faulted, so they can be relayed as raw
+	// bytes without being parsed into frames.
+	go func() {
+		io.Copy(clientWriter, backendConn)
+		clientConn.Close()
+	}()
+
+	p.proxyRequests(br, backendConn, clientWriter)
+}
+
+// passthrough relays a non-HTTP/2 connection, i.e. one of the emulator’s
+// plain HTTP/1.1 admin requests, unmodified in both directions.
+func (p *faultProxy) passthrough(clientConn net.Conn, br *bufio.Reader) {
+	backendConn, err := net.Dial("tcp", p.backend)
+	if err != nil {
+		return
+	}
+	defer backendConn.Close()
+
+	done := make(chan struct{})
+	go func() {
+		io.Copy(backendConn, br)
+		close(done)
+	}()
+	io.Copy(clientConn, backendConn)
+	<-done
+}
+
+// proxyRequests reads gRPC request frames sent by the client, forwards them
+// to the backend, and answers faulted RPCs directly instead of forwarding
+// them.  It decodes every HEADERS block to keep its HPACK decoder state in
+// sync with the client’s encoder, even for requests it doesn’t act on.
+func (p *faultProxy) proxyRequests(br *bufio.Reader, backendConn net.Conn, clientWriter *lockedWriter) {
+	clientFramer := http2.NewFramer(backendConn, br)
+	clientFramer.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+	responseFramer := http2.NewFramer(clientWriter, nil)
+
+	faulted := map[uint32]bool{}
+	for {
+		f, err := clientFramer.ReadFrame()
+		if err != nil {
+			return
+		}
+		switch f := f.(type) {
+		case *http2.MetaHeadersFrame:
+			method := requestMethod(f)
+			if response, ok := p.nextFault(method); ok {
+				if err := writeFaultResponse(responseFramer, f.StreamID, response); err != nil {
+					return
+				}
+				faulted[f.StreamID] = true
+				continue
+			}
+			if err := forwardHeaders(clientFramer, f); err != nil {
+				return
+			}
+		case *http2.DataFrame:
+			if faulted[f.StreamID] {
+				continue
+			}
+			if err := clientFramer.WriteData(f.StreamID, f.StreamEnded(), f.Data()); err != nil {
+				return
+			}
+		default:
+			if err := forwardFrame(clientFramer, f); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// requestMethod extracts the gRPC method, e.g.
+// "google.datastore.v1.Datastore/RunQuery", from a request’s ":path"
+// pseudo-header.
+func requestMethod(f *http2.MetaHeadersFrame) string {
+	for _, field := range f.Fields {
+		if field.Name == ":path" {
+			return strings.TrimPrefix(field.Value, "/")
+		}
+	}
+	return ""
+}
+
+// forwardHeaders re-encodes and forwards a decoded HEADERS block.
+// Re-encoding (rather than forwarding the original bytes) is necessary
+// because the backend connection has its own, independent HPACK dynamic
+// table that starts out empty.
+func forwardHeaders(fr *http2.Framer, mh *http2.MetaHeadersFrame) error {
+	var buf bytes.Buffer
+	enc := hpack.NewEncoder(&buf)
+	for _, field := range mh.Fields {
+		if err := enc.WriteField(field); err != nil {
+			return err
+		}
+	}
+	return fr.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      mh.StreamID,
+		BlockFragment: buf.Bytes(),
+		EndStream:     mh.StreamEnded(),
+		EndHeaders:    true,
+		Priority:      mh.Priority,
+	})
+}
+
+// forwardFrame forwards frame types that don’t need inspection.
+func forwardFrame(fr *http2.Framer, frame http2.Frame) error {
+	switch f := frame.(type) {
+	case *http2.SettingsFrame:
+		if f.IsAck() {
+			return fr.WriteSettingsAck()
+		}
+		var settings []http2.Setting
+		f.ForeachSetting(func(s http2.Setting) error {
+			settings = append(settings, s)
+			return nil
+		})
+		return fr.WriteSettings(settings...)
+	case *http2.WindowUpdateFrame:
+		return fr.WriteWindowUpdate(f.StreamID, f.Increment)
+	case *http2.PingFrame:
+		return fr.WritePing(f.IsAck(), f.Data)
+	case *http2.RSTStreamFrame:
+		return fr.WriteRSTStream(f.StreamID, f.ErrCode)
+	case *http2.PriorityFrame:
+		return fr.WritePriority(f.StreamID, f.PriorityParam)
+	case *http2.GoAwayFrame:
+		return fr.WriteGoAway(f.LastStreamID, f.ErrCode, f.DebugData())
+	default:
+		// Unknown frame types are dropped; clients never send
+		// PUSH_PROMISE, and CONTINUATION frames are consumed by
+		// ReadMetaHeaders above.
+		return nil
+	}
+}
+
+// writeFaultResponse answers a gRPC call with a trailers-only error
+// response carrying the status encoded in response, without forwarding the
+// call to the backend.
+func writeFaultResponse(fr *http2.Framer, streamID uint32, response string) error {
+	code, message := parseFault(response)
+	var buf bytes.Buffer
+	enc := hpack.NewEncoder(&buf)
+	fields := []hpack.HeaderField{
+		{Name: ":status", Value: "200"},
+		{Name: "content-type", Value: "application/grpc"},
+		{Name: "grpc-status", Value: strconv.Itoa(int(code))},
+		{Name: "grpc-message", Value: message},
+	}
+	for _, field := range fields {
+		if err := enc.WriteField(field); err != nil {
+			return err
+		}
+	}
+	return fr.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      streamID,
+		BlockFragment: buf.Bytes(),
+		EndStream:     true,
+		EndHeaders:    true,
+	})
+}
+
+// parseFault parses a response string as given to [Handle.InjectFaults],
+// i.e. a gRPC status code name optionally followed by ":" and a message.
+// Unknown code names are treated as [codes.Unavailable], the most common
+// fault to inject for retry tests.
+func parseFault(response string) (codes.Code, string) {
+	name, message, _ := strings.Cut(response, ":")
+	if code, ok := codeByName[name]; ok {
+		return code, message
+	}
+	return codes.Unavailable, fmt.Sprintf("dstest: unrecognized injected fault %q", response)
+}
+
+var codeByName = func() map[string]codes.Code {
+	m := make(map[string]codes.Code)
+	for c := codes.OK; c <= codes.Unauthenticated; c++ {
+		m[c.String()] = c
+	}
+	return m
+}()
+
+// lockedWriter serializes writes from multiple goroutines to w.
+type lockedWriter struct {
+	mu *sync.Mutex
+	w  io.Writer
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
+}
@@ -0,0 +1,42 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dstest_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/phst/dstest"
+)
+
+func TestFirestoreEmulator(t *testing.T) {
+	ctx := context.Background()
+	client := dstest.FirestoreEmulator(ctx, t)
+	doc := client.Collection("col").NewDoc()
+	if _, err := doc.Set(ctx, map[string]any{"value": 123}); err != nil {
+		t.Fatal(err)
+	}
+	snap, err := doc.Get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got struct{ Value int }
+	if err := snap.DataTo(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Value != 123 {
+		t.Errorf("got value %d, want 123", got.Value)
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dstest
+
+import (
+	"context"
+	"regexp"
+	"testing"
+
+	"cloud.google.com/go/pubsub"
+)
+
+var pubsubEnvRegexp = regexp.MustCompile(`^\[pubsub\] +export (PUBSUB_EMULATOR_HOST)=(.+)$`)
+
+// PubSubEmulator starts a Cloud Pub/Sub emulator; see
+// https://cloud.google.com/pubsub/docs/emulator.  When the test ends, the
+// returned client is automatically closed and the emulator process is
+// killed.  As with [Emulator], don’t pass t.Context() as ctx.  Of the
+// [Option] types, only [ProjectID], [StartTimeout], and [StopTimeout] apply
+// here; the others are ignored.
+func PubSubEmulator(ctx context.Context, t testing.TB, opts ...Option) *pubsub.Client {
+	t.Helper()
+	o := newOptions(opts)
+
+	args := []string{"beta", "emulators", "pubsub", "start"}
+	if o.projectID != "" {
+		args = append(args, "--project="+o.projectID)
+	}
+	env, _, shutdownProcess := runEmulator(ctx, t, o.startTimeout, o.stopTimeout, args, pubsubEnvRegexp)
+	t.Setenv(env.name, env.value)
+
+	projectID := o.projectID
+	if projectID == "" {
+		projectID = defaultProjectID
+	}
+	client, err := pubsub.NewClient(ctx, projectID)
+	if err != nil {
+		t.Fatalf("dstest: error creating Pub/Sub client: %s", err)
+	}
+	t.Cleanup(func() {
+		t.Log("dstest: closing Pub/Sub client")
+		if err := client.Close(); err != nil {
+			t.Logf("dstest: couldn’t close Pub/Sub client: %s", err)
+		}
+		shutdownProcess()
+	})
+	return client
+}
@@ -0,0 +1,52 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dstest_test
+
+import (
+	"context"
+	"testing"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/phst/dstest"
+)
+
+func TestPubSubEmulator(t *testing.T) {
+	ctx := context.Background()
+	client := dstest.PubSubEmulator(ctx, t)
+	topic, err := client.CreateTopic(ctx, "topic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := client.CreateSubscription(ctx, "sub", pubsub.SubscriptionConfig{Topic: topic})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := topic.Publish(ctx, &pubsub.Message{Data: []byte("hello")}).Get(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	var got string
+	if err := sub.Receive(ctx, func(_ context.Context, m *pubsub.Message) {
+		got = string(m.Data)
+		m.Ack()
+		cancel()
+	}); err != nil && ctx.Err() == nil {
+		t.Fatal(err)
+	}
+	if got != "hello" {
+		t.Errorf("got message %q, want %q", got, "hello")
+	}
+}